@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeframe — один запрошенный масштаб свечки в минутах.
+type Timeframe struct {
+	Minutes int
+}
+
+// SessionCalendar описывает торговые часы инструмента: часовой пояс, время
+// открытия и продолжительность сессии, а также список выходных/праздничных дней,
+// которые нужно пропускать при переносе на следующий торговый день.
+type SessionCalendar struct {
+	Location *time.Location
+	OpenTime string // "07:00:00.000000", как hourStart
+	Session  time.Duration
+	Holidays map[string]bool // "2006-01-02" -> выходной
+}
+
+// NewSessionCalendar загружает часовой пояс через time.LoadLocation и собирает
+// календарь сессии. holidays — список дат в формате "2006-01-02".
+func NewSessionCalendar(tz, openTime string, sessionHours int, holidays []string) (*SessionCalendar, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load location %q: %s", tz, err)
+	}
+
+	days := make(map[string]bool, len(holidays))
+	for _, d := range holidays {
+		days[strings.TrimSpace(d)] = true
+	}
+
+	return &SessionCalendar{
+		Location: loc,
+		OpenTime: openTime,
+		Session:  time.Duration(sessionHours) * time.Hour,
+		Holidays: days,
+	}, nil
+}
+
+// IsTradingDay сообщает, торгуем ли мы в эту дату — без выходных и праздников.
+func (c *SessionCalendar) IsTradingDay(day time.Time) bool {
+	wd := day.Weekday()
+	if wd == time.Saturday || wd == time.Sunday {
+		return false
+	}
+
+	return !c.Holidays[day.Format("2006-01-02")]
+}
+
+// SessionStart возвращает момент открытия торгов в указанный день, в часовом поясе календаря.
+func (c *SessionCalendar) SessionStart(day time.Time) (time.Time, error) {
+	date := day.Format("2006-01-02")
+	return time.ParseInLocation(timeFmt, fmt.Sprintf("%s %s", date, c.OpenTime), c.Location)
+}
+
+// SessionEnd возвращает момент закрытия сессии, начавшейся в start.
+func (c *SessionCalendar) SessionEnd(start time.Time) time.Time {
+	return start.Add(c.Session)
+}
+
+// SessionFor возвращает момент открытия сессии, которой принадлежит момент t.
+// Если t раньше времени открытия своего календарного дня, значит сессия
+// пересекает полночь и t всё ещё относится к сессии, открывшейся накануне.
+func (c *SessionCalendar) SessionFor(t time.Time) (time.Time, error) {
+	start, err := c.SessionStart(t)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if t.Before(start) {
+		return c.SessionStart(t.AddDate(0, 0, -1))
+	}
+
+	return start, nil
+}
+
+// NextSessionStart ищет следующий торговый день после `after` (пропуская выходные
+// и праздники) и возвращает момент его открытия.
+func (c *SessionCalendar) NextSessionStart(after time.Time) (time.Time, error) {
+	day := after.AddDate(0, 0, 1)
+	for !c.IsTradingDay(day) {
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return c.SessionStart(day)
+}
+
+// parseTimeframes разбирает флаг вида "5,30,240" в список Timeframe.
+func parseTimeframes(raw string) ([]Timeframe, error) {
+	parts := strings.Split(raw, ",")
+
+	tfs := make([]Timeframe, 0, len(parts))
+	for _, p := range parts {
+		minutes, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timeframe %q: %s", p, err)
+		}
+
+		tfs = append(tfs, Timeframe{Minutes: minutes})
+	}
+
+	return tfs, nil
+}
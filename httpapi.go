@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CandleBroadcaster раздаёт свежесформированные свечки подписчикам /candles/stream,
+// не завязываясь на то, как они были записаны в Store.
+type CandleBroadcaster struct {
+	mu   sync.Mutex
+	subs map[string][]chan Candle
+}
+
+// NewCandleBroadcaster создаёт пустой брокер подписок.
+func NewCandleBroadcaster() *CandleBroadcaster {
+	return &CandleBroadcaster{subs: make(map[string][]chan Candle)}
+}
+
+func streamKey(ticker string, tf int) string {
+	return fmt.Sprintf("%s|%d", ticker, tf)
+}
+
+// Subscribe регистрирует канал, в который будут приходить закрытые свечки указанного
+// тикера/таймфрейма. Возвращённая функция отписывает канал.
+func (b *CandleBroadcaster) Subscribe(ticker string, tf int) (chan Candle, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Candle, 16)
+	key := streamKey(ticker, tf)
+	b.subs[key] = append(b.subs[key], ch)
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		subs := b.subs[key]
+		for i, s := range subs {
+			if s == ch {
+				b.subs[key] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish отправляет свечку всем текущим подписчикам её тикера/таймфрейма.
+// Переполненные подписчики пропускаются, чтобы не блокировать пайплайн.
+func (b *CandleBroadcaster) Publish(c Candle, tf int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ch := range b.subs[streamKey(c.ticker, tf)] {
+		select {
+		case ch <- c:
+		default:
+			fmt.Printf("httpapi: dropping candle for slow subscriber %s\n", c.ticker)
+		}
+	}
+}
+
+// httpAPI хранит зависимости, нужные обработчикам запросов к хранилищу свечек.
+type httpAPI struct {
+	store       *Store
+	broadcaster *CandleBroadcaster
+	nativeTFs   []int
+}
+
+// StartHTTPAPI поднимает HTTP-сервис истории свечек поверх Store: GET /candles
+// отдаёт диапазон (с downsampling до запрошенного tf), а GET /candles/stream
+// отдаёт server-sent events со свежими свечками, которые публикует AppendInFile.
+func StartHTTPAPI(addr string, store *Store, broadcaster *CandleBroadcaster, nativeTFs []int) *http.Server {
+	api := &httpAPI{store: store, broadcaster: broadcaster, nativeTFs: nativeTFs}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/candles", api.handleCandles)
+	mux.HandleFunc("/candles/stream", api.handleCandlesStream)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("httpapi: server crashed: %s\n", err)
+		}
+	}()
+
+	return server
+}
+
+func (a *httpAPI) handleCandles(w http.ResponseWriter, r *http.Request) {
+	ticker := r.URL.Query().Get("ticker")
+	tf, err := strconv.Atoi(r.URL.Query().Get("tf"))
+	if ticker == "" || err != nil {
+		http.Error(w, "ticker and tf are required", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	candles, err := a.queryOrDownsample(ticker, tf, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "csv" {
+		writeCandlesCSV(w, candles)
+		return
+	}
+
+	writeCandlesJSON(w, candles)
+}
+
+// queryOrDownsample отдаёт свечки напрямую из сегмента, если tf хранится нативно
+// (один из таймфреймов флага -timeframes), иначе строит их на лету агрегацией самого мелкого
+// нативного tf, чтобы не требовать отдельного предвычисленного сегмента.
+func (a *httpAPI) queryOrDownsample(ticker string, tf int, from, to time.Time) ([]Candle, error) {
+	for _, native := range a.nativeTFs {
+		if native == tf {
+			return a.store.Query(ticker, tf, from, to)
+		}
+	}
+
+	base := a.nativeTFs[0]
+	for _, native := range a.nativeTFs {
+		if native < base {
+			base = native
+		}
+	}
+
+	if tf <= base {
+		return nil, fmt.Errorf("no native timeframe smaller than %dm to downsample from", tf)
+	}
+
+	if tf%base != 0 {
+		return nil, fmt.Errorf("requested timeframe %dm is not a multiple of the smallest native timeframe %dm", tf, base)
+	}
+
+	raw, err := a.store.Query(ticker, base, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return downsampleCandles(raw, base, tf), nil
+}
+
+// downsampleCandles склеивает свечки базового tf в свечки запрошенного большего
+// tf, группируя их по фактическому окну времени (а не по позиции в срезе), так
+// что пропуск в данных (тихий период без сделок) не сдвигает границы группы
+// относительно настенных часов.
+func downsampleCandles(raw []Candle, baseTF, targetTF int) []Candle {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	sort.Slice(raw, func(i, j int) bool { return raw[i].ts.Before(raw[j].ts) })
+
+	window := time.Duration(targetTF) * time.Minute
+
+	var out []Candle
+	var bucketStart time.Time
+	for _, c := range raw {
+		start := c.ts.Truncate(window)
+
+		if len(out) == 0 || !start.Equal(bucketStart) {
+			merged := c
+			merged.ts = start
+			out = append(out, merged)
+			bucketStart = start
+			continue
+		}
+
+		last := &out[len(out)-1]
+		if c.maxPrice > last.maxPrice {
+			last.maxPrice = c.maxPrice
+		}
+		if c.minPrice < last.minPrice {
+			last.minPrice = c.minPrice
+		}
+		last.closePrice = c.closePrice
+	}
+
+	return out
+}
+
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	fromStr := r.URL.Query().Get("from")
+	toStr := r.URL.Query().Get("to")
+
+	from, err := time.Parse(time.RFC3339, fromStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to parse from: %s", err)
+	}
+
+	to, err := time.Parse(time.RFC3339, toStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to parse to: %s", err)
+	}
+
+	return from, to, nil
+}
+
+func writeCandlesJSON(w http.ResponseWriter, candles []Candle) {
+	type jsonCandle struct {
+		Ticker string    `json:"ticker"`
+		TS     time.Time `json:"ts"`
+		Open   float64   `json:"open"`
+		High   float64   `json:"high"`
+		Low    float64   `json:"low"`
+		Close  float64   `json:"close"`
+	}
+
+	out := make([]jsonCandle, 0, len(candles))
+	for _, c := range candles {
+		out = append(out, jsonCandle{c.ticker, c.ts, c.openPrice, c.maxPrice, c.minPrice, c.closePrice})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		fmt.Printf("httpapi: unable to encode json response: %s\n", err)
+	}
+}
+
+func writeCandlesCSV(w http.ResponseWriter, candles []Candle) {
+	w.Header().Set("Content-Type", "text/csv")
+
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+
+	for _, c := range candles {
+		record := []string{
+			c.ticker,
+			c.ts.Format(time.RFC3339),
+			strconv.FormatFloat(c.openPrice, 'f', -1, 64),
+			strconv.FormatFloat(c.maxPrice, 'f', -1, 64),
+			strconv.FormatFloat(c.minPrice, 'f', -1, 64),
+			strconv.FormatFloat(c.closePrice, 'f', -1, 64),
+		}
+
+		if err := cw.Write(record); err != nil {
+			fmt.Printf("httpapi: unable to write csv row: %s\n", err)
+		}
+	}
+}
+
+func (a *httpAPI) handleCandlesStream(w http.ResponseWriter, r *http.Request) {
+	ticker := r.URL.Query().Get("ticker")
+	tf, err := strconv.Atoi(r.URL.Query().Get("tf"))
+	if ticker == "" || err != nil {
+		http.Error(w, "ticker and tf are required", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, unsubscribe := a.broadcaster.Subscribe(ticker, tf)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case candle, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			payload, err := json.Marshal(struct {
+				Ticker string    `json:"ticker"`
+				TS     time.Time `json:"ts"`
+				Open   float64   `json:"open"`
+				High   float64   `json:"high"`
+				Low    float64   `json:"low"`
+				Close  float64   `json:"close"`
+			}{candle.ticker, candle.ts, candle.openPrice, candle.maxPrice, candle.minPrice, candle.closePrice})
+			if err != nil {
+				fmt.Printf("httpapi: unable to marshal stream candle: %s\n", err)
+				continue
+			}
+
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func candleAt(t time.Time, open, max, min, close float64) Candle {
+	return Candle{ts: t, openPrice: open, maxPrice: max, minPrice: min, closePrice: close}
+}
+
+// TestDownsampleCandlesBucketsByTimeNotIndex воспроизводит регрессию: раньше
+// свечки группировались по позиции в срезе (raw[i:i+groupSize]), так что пропуск
+// в базовом ряду сдвигал все последующие группы относительно настенных часов.
+func TestDownsampleCandlesBucketsByTimeNotIndex(t *testing.T) {
+	base := time.Date(2026, 7, 24, 7, 0, 0, 0, time.UTC)
+
+	// 5m свечки за 07:00, 07:05 (пропуск 07:10-07:20), 07:25, 07:55.
+	// При targetTF=30 ожидаем окна [07:00,07:30) и [07:30,08:00).
+	raw := []Candle{
+		candleAt(base, 100, 105, 95, 101),
+		candleAt(base.Add(5*time.Minute), 101, 110, 100, 108),
+		candleAt(base.Add(25*time.Minute), 108, 120, 107, 115),
+		candleAt(base.Add(55*time.Minute), 200, 210, 195, 205),
+	}
+
+	got := downsampleCandles(raw, 5, 30)
+
+	if len(got) != 2 {
+		t.Fatalf("got %d candles, want 2 (one per 30m window): %+v", len(got), got)
+	}
+
+	first := got[0]
+	if !first.ts.Equal(base) {
+		t.Errorf("first bucket ts = %v, want %v", first.ts, base)
+	}
+	if first.openPrice != 100 || first.closePrice != 115 || first.maxPrice != 120 || first.minPrice != 95 {
+		t.Errorf("first bucket = %+v, want open=100 close=115 max=120 min=95", first)
+	}
+
+	second := got[1]
+	if !second.ts.Equal(base.Add(30 * time.Minute)) {
+		t.Errorf("second bucket ts = %v, want %v", second.ts, base.Add(30*time.Minute))
+	}
+	if second.openPrice != 200 || second.closePrice != 205 {
+		t.Errorf("second bucket = %+v, want open=200 close=205", second)
+	}
+}
+
+func TestQueryOrDownsampleRejectsNonMultipleTimeframe(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore: %s", err)
+	}
+	defer store.Close()
+
+	api := &httpAPI{store: store, nativeTFs: []int{5, 30, 240}}
+
+	if _, err := api.queryOrDownsample("TEST", 7, time.Unix(0, 0), time.Unix(1e9, 0)); err == nil {
+		t.Fatal("expected an error for tf=7 (not a multiple of the smallest native timeframe 5), got nil")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tick — одна сделка/котировка, независимая от источника, из которого она пришла.
+type Tick struct {
+	Ticker string
+	Price  float64
+	Volume float64
+	TS     time.Time
+}
+
+// TickSource абстрагирует StageOne от конкретного транспорта: файла, бинарного
+// формата брокера или живого потока с биржи.
+type TickSource interface {
+	Next(ctx context.Context) (Tick, error)
+	Close() error
+}
+
+// --- CSV источник ------------------------------------------------------------
+
+// csvTickSource читает тики из уже существующего CSV-формата (ticker,price,volume,ts).
+type csvTickSource struct {
+	file *os.File
+	r    *csv.Reader
+}
+
+func newCSVTickSource(path string) (*csvTickSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open csv source: %s", err)
+	}
+
+	return &csvTickSource{file: file, r: csv.NewReader(file)}, nil
+}
+
+func (s *csvTickSource) Next(ctx context.Context) (Tick, error) {
+	record, err := s.r.Read()
+	if err != nil {
+		return Tick{}, err
+	}
+
+	price, err := strconv.ParseFloat(record[1], 64)
+	if err != nil {
+		return Tick{}, fmt.Errorf("unable to parse price: %s", err)
+	}
+
+	var volume float64
+	if len(record) > 2 {
+		volume, _ = strconv.ParseFloat(record[2], 64)
+	}
+
+	ts, err := time.Parse(timeFmt, record[3])
+	if err != nil {
+		return Tick{}, fmt.Errorf("unable to parse ts: %s", err)
+	}
+
+	return Tick{Ticker: record[0], Price: price, Volume: volume, TS: ts}, nil
+}
+
+func (s *csvTickSource) Close() error {
+	return s.file.Close()
+}
+
+// --- Dukascopy-style bi5 источник --------------------------------------------
+
+const bi5RecSize = 32
+
+// bi5HourFmt — формат часа, от которого bi5-файл отсчитывает ms-offset, как в
+// пути Dukascopy (.../2024/06/24/07h_ticks.bi5 -> "2024-06-24T07").
+const bi5HourFmt = "2006-01-02T15"
+
+// bi5TickSource читает тики из бинарного файла брокера: записи фиксированной
+// ширины (ms-offset, ask, bid, askVol, bidVol), цены восстанавливаются через pointValue.
+type bi5TickSource struct {
+	file       *os.File
+	ticker     string
+	pointValue float64
+	hourStart  time.Time
+}
+
+func newBi5TickSource(path, ticker string, pointValue float64, hourStart time.Time) (*bi5TickSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bi5 source: %s", err)
+	}
+
+	return &bi5TickSource{file: file, ticker: ticker, pointValue: pointValue, hourStart: hourStart}, nil
+}
+
+func (s *bi5TickSource) Next(ctx context.Context) (Tick, error) {
+	rec := make([]byte, bi5RecSize)
+
+	if _, err := io.ReadFull(s.file, rec); err != nil {
+		return Tick{}, err
+	}
+
+	msOffset := binary.BigEndian.Uint32(rec[0:4])
+	ask := binary.BigEndian.Uint32(rec[4:8])
+	bid := binary.BigEndian.Uint32(rec[8:12])
+
+	ts := s.hourStart.Add(time.Duration(msOffset) * time.Millisecond)
+	price := (float64(ask) + float64(bid)) / 2 / s.pointValue
+
+	askVol := math.Float32frombits(binary.BigEndian.Uint32(rec[12:16]))
+	bidVol := math.Float32frombits(binary.BigEndian.Uint32(rec[16:20]))
+
+	return Tick{Ticker: s.ticker, Price: price, Volume: float64(askVol + bidVol), TS: ts}, nil
+}
+
+func (s *bi5TickSource) Close() error {
+	return s.file.Close()
+}
+
+// --- Живой HTTP/WebSocket источник -------------------------------------------
+
+// wsTick — формат JSON-тика, который отдаёт эндпоинт биржи.
+type wsTick struct {
+	Ticker string  `json:"ticker"`
+	Price  float64 `json:"price"`
+	Volume float64 `json:"volume"`
+	TS     string  `json:"ts"`
+}
+
+// wsTickSource вычитывает построчный JSON-поток с живого эндпоинта биржи.
+// Принимает как ws://, так и http(s):// адреса — в обоих случаях ожидается
+// потоковый (chunked) ответ с одним JSON-объектом на строку.
+type wsTickSource struct {
+	resp *http.Response
+	dec  *json.Decoder
+}
+
+func newWSTickSource(url string) (*wsTickSource, error) {
+	httpURL := strings.Replace(strings.Replace(url, "ws://", "http://", 1), "wss://", "https://", 1)
+
+	resp, err := http.Get(httpURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to live source: %s", err)
+	}
+
+	return &wsTickSource{resp: resp, dec: json.NewDecoder(resp.Body)}, nil
+}
+
+func (s *wsTickSource) Next(ctx context.Context) (Tick, error) {
+	var t wsTick
+
+	done := make(chan error, 1)
+	go func() { done <- s.dec.Decode(&t) }()
+
+	select {
+	case <-ctx.Done():
+		return Tick{}, ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return Tick{}, err
+		}
+	}
+
+	ts, err := time.Parse(time.RFC3339, t.TS)
+	if err != nil {
+		return Tick{}, fmt.Errorf("unable to parse ts: %s", err)
+	}
+
+	return Tick{Ticker: t.Ticker, Price: t.Price, Volume: t.Volume, TS: ts}, nil
+}
+
+func (s *wsTickSource) Close() error {
+	return s.resp.Body.Close()
+}
+
+// --- Композитный источник: файл -> живой поток -------------------------------
+
+// compositeTickSource читает исторические тики из primary, а по его EOF
+// прозрачно переключается на live, не прерывая пайплайн.
+type compositeTickSource struct {
+	primary TickSource
+	live    TickSource
+	onLive  bool
+}
+
+func newCompositeTickSource(primary, live TickSource) *compositeTickSource {
+	return &compositeTickSource{primary: primary, live: live}
+}
+
+func (s *compositeTickSource) Next(ctx context.Context) (Tick, error) {
+	if s.onLive || s.primary == nil {
+		return s.live.Next(ctx)
+	}
+
+	tick, err := s.primary.Next(ctx)
+	if err == io.EOF {
+		if err := s.primary.Close(); err != nil {
+			fmt.Printf("unable to close primary source: %s\n", err)
+		}
+
+		if s.live == nil {
+			return Tick{}, io.EOF
+		}
+
+		s.onLive = true
+		return s.live.Next(ctx)
+	}
+
+	return tick, err
+}
+
+func (s *compositeTickSource) Close() error {
+	if s.onLive && s.live != nil {
+		return s.live.Close()
+	}
+	if s.primary != nil {
+		return s.primary.Close()
+	}
+	return nil
+}
+
+// --- Выбор источника по флагу -source ----------------------------------------
+
+// newTickSource разбирает флаг -source=csv|bi5:<path>:<ticker>:<pointValue>:<hour>|ws://...
+// и возвращает соответствующую реализацию TickSource.
+func newTickSource(sourceFlag, csvPath string) (TickSource, error) {
+	switch {
+	case sourceFlag == "" || sourceFlag == "csv":
+		return newCSVTickSource(csvPath)
+
+	case strings.HasPrefix(sourceFlag, "bi5:"):
+		parts := strings.Split(strings.TrimPrefix(sourceFlag, "bi5:"), ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("bi5 source must be bi5:<path>:<ticker>:<pointValue>:<hour>")
+		}
+
+		pointValue, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse bi5 point value: %s", err)
+		}
+
+		hourStart, err := time.Parse(bi5HourFmt, parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse bi5 hour %q (want %s): %s", parts[3], bi5HourFmt, err)
+		}
+
+		return newBi5TickSource(parts[0], parts[1], pointValue, hourStart)
+
+	case strings.HasPrefix(sourceFlag, "ws://") || strings.HasPrefix(sourceFlag, "wss://"):
+		return newWSTickSource(sourceFlag)
+
+	default:
+		return nil, fmt.Errorf("unknown source: %s", sourceFlag)
+	}
+}
+
+// peekFirstTickTime открывает независимый экземпляр источника, чтобы найти
+// день первой записи, и возвращает начало торговой сессии этого дня по calendar.
+func peekFirstTickTime(sourceFlag, csvPath string, calendar *SessionCalendar) (time.Time, error) {
+	if strings.HasPrefix(sourceFlag, "ws://") || strings.HasPrefix(sourceFlag, "wss://") {
+		return calendar.SessionStart(time.Now())
+	}
+
+	src, err := newTickSource(sourceFlag, csvPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer src.Close()
+
+	tick, err := src.Next(context.Background())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to read first tick: %s", err)
+	}
+
+	return calendar.SessionStart(tick.TS)
+}
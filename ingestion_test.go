@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeBi5Record(t *testing.T, file *os.File, msOffset, ask, bid uint32, askVol, bidVol float32) {
+	t.Helper()
+
+	rec := make([]byte, bi5RecSize)
+	binary.BigEndian.PutUint32(rec[0:4], msOffset)
+	binary.BigEndian.PutUint32(rec[4:8], ask)
+	binary.BigEndian.PutUint32(rec[8:12], bid)
+	binary.BigEndian.PutUint32(rec[12:16], math.Float32bits(askVol))
+	binary.BigEndian.PutUint32(rec[16:20], math.Float32bits(bidVol))
+
+	if _, err := file.Write(rec); err != nil {
+		t.Fatalf("write bi5 record: %s", err)
+	}
+}
+
+// TestNewTickSourceBi5UsesFlagHour проверяет, что час, от которого bi5-источник
+// отсчитывает ms-offset, берётся из 4-го поля флага -source, а не из time.Now().
+func TestNewTickSourceBi5UsesFlagHour(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/07h_ticks.bi5"
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create bi5 file: %s", err)
+	}
+	writeBi5Record(t, file, 90_000, 110_000, 109_900, 1.5, 2.5)
+	if err := file.Close(); err != nil {
+		t.Fatalf("close bi5 file: %s", err)
+	}
+
+	src, err := newTickSource("bi5:"+path+":EURUSD:100000:2024-06-24T07", "")
+	if err != nil {
+		t.Fatalf("newTickSource: %s", err)
+	}
+	defer src.Close()
+
+	tick, err := src.Next(nil)
+	if err != nil {
+		t.Fatalf("Next: %s", err)
+	}
+
+	wantTS := time.Date(2024, 6, 24, 7, 0, 0, 0, time.UTC).Add(90_000 * time.Millisecond)
+	if !tick.TS.Equal(wantTS) {
+		t.Errorf("tick.TS = %v, want %v (derived from flag hour, not time.Now())", tick.TS, wantTS)
+	}
+}
+
+func TestNewTickSourceBi5RejectsMissingHour(t *testing.T) {
+	if _, err := newTickSource("bi5:file.bi5:EURUSD:100000", ""); err == nil {
+		t.Fatal("expected error for bi5 source missing the <hour> field, got nil")
+	}
+}
@@ -2,12 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,7 +17,6 @@ const (
 	timeFmt   = "2006-01-02 15:04:05.000000"
 	hourStart = "07:00:00.000000"
 	period    = 20
-	dayHour   = 24
 	cnsl      = 5
 )
 
@@ -41,36 +39,87 @@ func main() {
 // Функция запуска пайплайна.
 func pipeline() error {
 	// Парсинг входных аргументов.
-	var cmd string
+	var cmd, source, live, apiAddr, metricsAddr, tz, sessionOpen, timeframesFlag, dest string
+	var sessionHours, shardCount, bufferSize int
 	flag.StringVar(&cmd, "flag", "trades.csv", "Path to the file with trades.")
+	flag.StringVar(&dest, "dest", "./candles", "Output directory for partitioned candle CSVs.")
+	flag.StringVar(&source, "source", "csv", "Tick source: csv|bi5:<path>:<ticker>:<pointValue>:<hour, 2006-01-02T15>|ws://...")
+	flag.StringVar(&live, "live", "", "Optional live source (ws://...) to switch to once the primary source hits EOF.")
+	flag.StringVar(&apiAddr, "api", "", "Optional address to serve the /candles HTTP API on, e.g. :8080.")
+	flag.StringVar(&metricsAddr, "metrics", "", "Optional address to serve Prometheus /metrics on, e.g. :9090.")
+	flag.StringVar(&tz, "tz", "UTC", "Session calendar timezone, loaded via time.LoadLocation.")
+	flag.StringVar(&sessionOpen, "session-open", hourStart, "Session open time, e.g. 07:00:00.000000.")
+	flag.IntVar(&sessionHours, "session-hours", period, "Trading session length in hours.")
+	flag.StringVar(&timeframesFlag, "timeframes", "5,30,240", "Comma-separated list of candle timeframes in minutes.")
+	flag.IntVar(&shardCount, "shards", 4, "Number of per-ticker aggregation shards.")
+	flag.IntVar(&bufferSize, "buffer", 256, "Size of each shard's input queue and flush ring buffer.")
 	flag.Parse()
 
-	start, err := findDate(cmd)
+	if err := validateShardConfig(shardCount, bufferSize); err != nil {
+		return err
+	}
+
+	calendar, err := NewSessionCalendar(tz, sessionOpen, sessionHours, nil)
 	if err != nil {
-		return fmt.Errorf("func findDate crash: %s", err)
+		return fmt.Errorf("func NewSessionCalendar crash: %s", err)
 	}
 
-	duration := cnsl * time.Second
+	timeframes, err := parseTimeframes(timeframesFlag)
+	if err != nil {
+		return fmt.Errorf("func parseTimeframes crash: %s", err)
+	}
 
-	// Создание контекста с таймаутом.
-	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	start, err := peekFirstTickTime(source, cmd, calendar)
+	if err != nil {
+		return fmt.Errorf("func peekFirstTickTime crash: %s", err)
+	}
+
+	// Таймаут пайплайна применим только к батчевым прогонам по историческому файлу:
+	// живой источник обязан работать неограниченно долго, иначе -live=ws://...
+	// обрывается через cnsl секунд независимо от того, есть ли ещё данные.
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if live != "" || strings.HasPrefix(source, "ws://") || strings.HasPrefix(source, "wss://") {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithTimeout(context.Background(), cnsl*time.Second)
+	}
 	defer cancel()
 
 	out := make(chan struct{})
 
+	primary, err := newTickSource(source, cmd)
+	if err != nil {
+		return fmt.Errorf("func newTickSource crash: %s", err)
+	}
+
+	var src TickSource = primary
+	if live != "" {
+		liveSrc, err := newTickSource(live, "")
+		if err != nil {
+			return fmt.Errorf("func newTickSource (live) crash: %s", err)
+		}
+		src = newCompositeTickSource(primary, liveSrc)
+	}
+
 	// Запуск первой стадии и получение канала строк.
-	fileChan, in, err := StageOne(ctx, cmd, start)
+	fileChan, in, err := StageOne(ctx, src, calendar, start)
 	if err != nil {
 		return fmt.Errorf("func StageOne crash %s", err)
 	}
 
-	// Разделение одного канала на три, для каждого обработчика.
-	ch5, ch30, ch240 := SeparateChan(fileChan)
+	metrics := NewMetrics(shardCount)
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		server := &http.Server{Addr: metricsAddr, Handler: mux}
+		go server.ListenAndServe()
+		defer server.Close()
+	}
 
-	// Запуск второй стадии для свечек разного масштаба.
-	cdl5 := StageTwo(ch5, 5, start)
-	cdl30 := StageTwo(ch30, 30, start)
-	cdl240 := StageTwo(ch240, 240, start)
+	// Запуск второй стадии: шардирование по тикеру между пулом воркеров,
+	// каждый из которых ведёт свою мапу свечек на каждый настроенный таймфрейм.
+	cdlChans := ShardedAggregate(fileChan, timeframes, calendar, start, shardCount, bufferSize, metrics)
 
 	go func() {
 		defer close(out)
@@ -79,59 +128,83 @@ func pipeline() error {
 
 	in <- struct{}{}
 
+	// Открываем персистентное хранилище свечек (сегменты + WAL) для устойчивости к падениям.
+	store, err := NewStore("./tsdata")
+	if err != nil {
+		return fmt.Errorf("func NewStore crash: %s", err)
+	}
+	defer store.Close()
+
+	broadcaster := NewCandleBroadcaster()
+
+	if apiAddr != "" {
+		nativeTFs := make([]int, len(timeframes))
+		for i, tf := range timeframes {
+			nativeTFs[i] = tf.Minutes
+		}
+
+		server := StartHTTPAPI(apiAddr, store, broadcaster, nativeTFs)
+		defer server.Close()
+	}
+
 	// Запуск третьей стадии.
-	StageThree(out, cdl5, cdl30, cdl240)
+	StageThree(out, store, broadcaster, dest, calendar, timeframes, cdlChans...)
 
 	return nil
 }
 
-// Первая стадия. Принимает на вход имя файла, контекст завершения и стартовое время.
-// Возвращает канал строк и возможную ошибку.
-func StageOne(ctx context.Context, path string, tStart time.Time) (chan []string, chan struct{}, error) {
+// Первая стадия. Принимает на вход источник тиков, контекст завершения, календарь сессии
+// и стартовое время. Возвращает канал строк и возможную ошибку. Источник может быть
+// историческим файлом, живым потоком или их комбинацией (см. compositeTickSource).
+func StageOne(ctx context.Context, src TickSource, calendar *SessionCalendar, tStart time.Time) (chan []string, chan struct{}, error) {
 	out := make(chan []string)
 
 	in := make(chan struct{})
 
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, nil, fmt.Errorf("unable to open file: %s", err)
-	}
-
-	r := csv.NewReader(file)
-
-	// Время начала торгов.
-	tEnd := tStart.Add(time.Hour * time.Duration(period))
+	// Время конца торговой сессии по календарю.
+	tEnd := calendar.SessionEnd(tStart)
 
-	go func(file *os.File) {
-		defer file.Close()
+	go func() {
+		defer src.Close()
 		defer close(out)
 		defer close(in)
 
 		<-in
 
 		for {
-			record, err := r.Read()
+			tick, err := src.Next(ctx)
 			if err == io.EOF {
 				return
 			}
 
 			if err != nil {
-				fmt.Printf("unable to read line: %s\n", err)
+				fmt.Printf("unable to read tick: %s\n", err)
 				return
 			}
 
-			inputTime, _ := time.Parse(timeFmt, record[3])
+			inputTime := tick.TS
 
-			// Если запись после времени конца торгов,
-			// то переностим стартовое время на дату следующего дня.
+			// Если запись после времени конца торгов, то переносим стартовое время
+			// на следующий торговый день по календарю (пропуская выходные/праздники).
 			if inputTime.After(tEnd) {
-				tStart = tStart.Add(dayHour * time.Hour)
-				tEnd = tStart.Add(time.Hour * time.Duration(period))
+				tStart, err = calendar.NextSessionStart(tStart)
+				if err != nil {
+					fmt.Printf("unable to compute next session start: %s\n", err)
+					return
+				}
+				tEnd = calendar.SessionEnd(tStart)
 			}
 
 			// Если запись попадает в промежуток, когда тогруем,
 			// то отправляем валидную запись в канал,.
 			if inputTime.After(tStart) && inputTime.Before(tEnd) {
+				record := []string{
+					tick.Ticker,
+					strconv.FormatFloat(tick.Price, 'f', -1, 64),
+					strconv.FormatFloat(tick.Volume, 'f', -1, 64),
+					inputTime.Format(timeFmt),
+				}
+
 				select {
 				case <-ctx.Done():
 					fmt.Println("ctx is done")
@@ -141,135 +214,51 @@ func StageOne(ctx context.Context, path string, tStart time.Time) (chan []string
 				}
 			}
 		}
-	}(file)
+	}()
 
 	return out, in, nil
 }
 
-// Запуск второй стадии. Принимаем канал для чтения и масштаб. Возвращаем выходной канал.
-// Цену открытия и закрытия мы считаем как внутренний интервал.
-func StageTwo(in chan []string, scale int, startTime time.Time) chan Candle {
-	varTime := startTime
-
-	// Мапа для отслеживаемых свечей.
-	// Из нее будем отправлять данные после завершения периода.
-	tickers := make(map[string]Candle)
-	out := make(chan Candle)
-
-	go func(in chan []string) {
-		defer close(out)
-
-		// Принимаем строки из файла через канал.
-		for s := range in {
-			t, err := time.Parse(timeFmt, s[3])
-			if err != nil {
-				fmt.Printf("unable to parse time %s\n", err)
-			}
-
-			// Если пришла запись с временем после масштаба свечки, то выгружаем а канал все хранящиеся свечки.
-			if t.After(varTime.Add(time.Duration(scale) * time.Minute)) {
-				varTime = varTime.Add(time.Duration(scale) * time.Minute)
-
-				tickers = dropTickers(out, tickers)
-			}
-
-			// Если запись с временем за предеделами торгового дня, то переводим время на начало следующего.
-			if t.After(startTime.Add(period * time.Hour)) {
-				varTime = startTime.Add(dayHour * time.Hour)
-				startTime = varTime
-				tickers[s[0]] = Candle{}
-			}
-
-			// Если в мапе по тикеру храниться пустой объект, то с пришедшей записи начинаем формирование свечки.
-			// Если нет, то корректируем хранящюуся свечку.
-			if candle := tickers[s[0]]; (candle == Candle{}) {
-				candle, err := newCandle(s, varTime)
-				if err != nil {
-					fmt.Printf("func newCandle crash: %s\n", err)
-				}
-
-				tickers[s[0]] = candle
-			} else {
-				tickers[s[0]] = changeCandle(s, tickers[s[0]])
-			}
-		}
-
-		// Если канал закрыт, то выгружаем оставшиеся свечки.
-		_ = dropTickers(out, tickers)
-	}(in)
-
-	return out
-}
-
-func dropTickers(out chan Candle, tickers map[string]Candle) map[string]Candle {
-	for k, v := range tickers {
-		if (v != Candle{}) {
-			out <- v
-
-			tickers[k] = Candle{}
-		}
-	}
-
-	return tickers
-}
-
-// Третья стадия. Получаем список каналов и начинаем писать информацию из них в файлы.
-func StageThree(out chan struct{}, chans ...chan Candle) {
+// Третья стадия. Получаем список каналов (по одному на настроенный таймфрейм) и
+// начинаем писать информацию из них в партиционированные CSV, одновременно сохраняя
+// свечки в персистентное хранилище tsstore и публикуя их подписчикам HTTP API.
+func StageThree(out chan struct{}, store *Store, broadcaster *CandleBroadcaster, dest string, calendar *SessionCalendar, timeframes []Timeframe, chans ...chan Candle) {
 	var wg sync.WaitGroup
 
 	wg.Add(len(chans))
 
-	ch5 := chans[0]
-	ch30 := chans[1]
-	ch240 := chans[2]
-
-	go AppendInFile(ch5, "./candles_5m.csv", &wg)
-	go AppendInFile(ch30, "./candles_30m.csv", &wg)
-	go AppendInFile(ch240, "./candles_240m.csv", &wg)
+	for i, ch := range chans {
+		tf := timeframes[i]
+		go AppendInFile(ch, dest, tf.Minutes, store, broadcaster, calendar, &wg)
+	}
 
 	wg.Wait()
 	out <- struct{}{}
 }
 
-// Функция записи данных из канала в файл.
-func AppendInFile(in chan Candle, fileName string, wg *sync.WaitGroup) {
+// Функция записи данных из канала в партиционированный CSV (<dest>/<SYMBOL>/<YYYY>/<MM>/<DD>/<TF>m.csv),
+// в персистентное хранилище и в эфир /candles/stream.
+func AppendInFile(in chan Candle, dest string, tf int, store *Store, broadcaster *CandleBroadcaster, calendar *SessionCalendar, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	file, err := os.Create(fileName)
-	if err != nil {
-		fmt.Printf("unable to open file %s\n", err)
-	}
-	defer file.Close()
+	writer := newPartitionedWriter(dest, tf, calendar)
+	defer func() {
+		if err := writer.Close(); err != nil {
+			fmt.Printf("unable to finalize partitioned writer: %s\n", err)
+		}
+	}()
 
 	for candle := range in {
-		t := candle.ts.Format("2006-01-02T15:04:05Z")
-
-		note := fmt.Sprintf("%s,%v,%v,%v,%v,%v\n", candle.ticker, t, candle.openPrice, candle.maxPrice, candle.minPrice, candle.closePrice)
-		if _, err := file.WriteString(note); err != nil {
-			fmt.Printf("unable to write in file: %s", err)
+		if err := writer.Write(candle); err != nil {
+			fmt.Printf("unable to write in file: %s\n", err)
 		}
-	}
-}
 
-// Функция разделение одного входного канала на три выходных.
-func SeparateChan(in chan []string) (chan []string, chan []string, chan []string) {
-	ch5 := make(chan []string)
-	ch30 := make(chan []string)
-	ch240 := make(chan []string)
-
-	go func(chan []string, chan []string, chan []string) {
-		defer close(ch5)
-		defer close(ch30)
-		defer close(ch240)
-
-		for s := range in {
-			ch5 <- s
-			ch30 <- s
-			ch240 <- s
+		if err := store.AppendTF(candle, tf); err != nil {
+			fmt.Printf("unable to persist candle to store: %s\n", err)
 		}
-	}(ch5, ch30, ch240)
 
-	return ch5, ch30, ch240
+		broadcaster.Publish(candle, tf)
+	}
 }
 
 // Функция создания новой свечки.
@@ -311,28 +300,3 @@ func changeCandle(s []string, candle Candle) Candle {
 
 	return candle
 }
-
-// Нахождение дня начала сбора данных.
-func findDate(path string) (time.Time, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("unable to open file: %s", err)
-	}
-	defer file.Close()
-
-	r := csv.NewReader(file)
-
-	record, err := r.Read()
-	if err != nil {
-		return time.Time{}, fmt.Errorf("unable to read line: %s", err)
-	}
-
-	day := strings.Split(record[3], " ")[0]
-
-	t, err := time.Parse(timeFmt, fmt.Sprintf("%s %s", day, hourStart))
-	if err != nil {
-		return time.Time{}, fmt.Errorf("unable to parse time: %s", err)
-	}
-
-	return t, nil
-}
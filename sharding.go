@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics собирает метрики бэкпрешера шардированной агрегации и отдаёт их
+// в формате, понятном Prometheus, через /metrics.
+type Metrics struct {
+	queueDepth        []int64
+	droppedTicks      int64
+	flushLatencyNanos int64
+	flushCount        int64
+}
+
+// NewMetrics создаёт метрики для заданного числа шардов.
+func NewMetrics(shards int) *Metrics {
+	return &Metrics{queueDepth: make([]int64, shards)}
+}
+
+func (m *Metrics) setQueueDepth(shard, n int) {
+	atomic.StoreInt64(&m.queueDepth[shard], int64(n))
+}
+
+func (m *Metrics) incDropped() {
+	atomic.AddInt64(&m.droppedTicks, 1)
+}
+
+func (m *Metrics) recordFlush(d time.Duration) {
+	atomic.AddInt64(&m.flushLatencyNanos, int64(d))
+	atomic.AddInt64(&m.flushCount, 1)
+}
+
+// ServeHTTP отдаёт метрики в текстовом формате Prometheus exposition.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "# HELP candle_pipeline_queue_depth Number of ticks queued per shard worker.")
+	fmt.Fprintln(w, "# TYPE candle_pipeline_queue_depth gauge")
+	for i := range m.queueDepth {
+		fmt.Fprintf(w, "candle_pipeline_queue_depth{shard=\"%d\"} %d\n", i, atomic.LoadInt64(&m.queueDepth[i]))
+	}
+
+	fmt.Fprintln(w, "# HELP candle_pipeline_dropped_ticks_total Ticks dropped because a shard's input queue was full, plus candles dropped because its flush ring buffer was full.")
+	fmt.Fprintln(w, "# TYPE candle_pipeline_dropped_ticks_total counter")
+	fmt.Fprintf(w, "candle_pipeline_dropped_ticks_total %d\n", atomic.LoadInt64(&m.droppedTicks))
+
+	fmt.Fprintln(w, "# HELP candle_pipeline_flush_latency_ms_avg Average time to flush a shard's tickers into its ring buffer.")
+	fmt.Fprintln(w, "# TYPE candle_pipeline_flush_latency_ms_avg gauge")
+	fmt.Fprintf(w, "candle_pipeline_flush_latency_ms_avg %f\n", m.avgFlushLatencyMs())
+}
+
+func (m *Metrics) avgFlushLatencyMs() float64 {
+	count := atomic.LoadInt64(&m.flushCount)
+	if count == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&m.flushLatencyNanos)) / float64(count) / float64(time.Millisecond)
+}
+
+// candleRing — фиксированного размера кольцевой буфер свечек между шардом и
+// стадией записи. Переполнение не блокирует шард, а отбрасывает свечку.
+type candleRing struct {
+	mu   sync.Mutex
+	buf  []Candle
+	head int
+	size int
+}
+
+func newCandleRing(capacity int) *candleRing {
+	return &candleRing{buf: make([]Candle, capacity)}
+}
+
+func (r *candleRing) push(c Candle) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size == len(r.buf) {
+		return false
+	}
+
+	r.buf[(r.head+r.size)%len(r.buf)] = c
+	r.size++
+
+	return true
+}
+
+func (r *candleRing) pop() (Candle, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size == 0 {
+		return Candle{}, false
+	}
+
+	c := r.buf[r.head]
+	r.head = (r.head + 1) % len(r.buf)
+	r.size--
+
+	return c, true
+}
+
+// shardWorker обрабатывает подмножество тикеров, определяемое hash(ticker) % N,
+// и держит собственную мапу свечек по каждому настроенному таймфрейму.
+type shardWorker struct {
+	id           int
+	in           chan []string
+	timeframes   []Timeframe
+	calendar     *SessionCalendar
+	sessionStart map[int]time.Time
+	varTime      map[int]time.Time
+	tickers      map[int]map[string]Candle
+	rings        map[int]*candleRing
+	metrics      *Metrics
+}
+
+func newShardWorker(id int, timeframes []Timeframe, calendar *SessionCalendar, startTime time.Time, bufferSize int, metrics *Metrics) *shardWorker {
+	w := &shardWorker{
+		id:           id,
+		in:           make(chan []string, bufferSize),
+		timeframes:   timeframes,
+		calendar:     calendar,
+		sessionStart: make(map[int]time.Time),
+		varTime:      make(map[int]time.Time),
+		tickers:      make(map[int]map[string]Candle),
+		rings:        make(map[int]*candleRing),
+		metrics:      metrics,
+	}
+
+	for _, tf := range timeframes {
+		w.sessionStart[tf.Minutes] = startTime
+		w.varTime[tf.Minutes] = startTime
+		w.tickers[tf.Minutes] = make(map[string]Candle)
+		w.rings[tf.Minutes] = newCandleRing(bufferSize)
+	}
+
+	return w
+}
+
+// run — тело воркера шарда: та же логика, что раньше жила в StageTwo, но
+// применяется параллельно для всех настроенных таймфреймов одного шарда.
+func (w *shardWorker) run() {
+	for s := range w.in {
+		t, err := time.Parse(timeFmt, s[3])
+		if err != nil {
+			fmt.Printf("shard %d: unable to parse time %s\n", w.id, err)
+			continue
+		}
+
+		for _, tf := range w.timeframes {
+			w.processTick(s, t, tf)
+		}
+	}
+
+	for _, tf := range w.timeframes {
+		w.flushTickers(tf.Minutes)
+	}
+}
+
+func (w *shardWorker) processTick(s []string, t time.Time, tf Timeframe) {
+	varTime := w.varTime[tf.Minutes]
+
+	if t.After(varTime.Add(time.Duration(tf.Minutes) * time.Minute)) {
+		varTime = varTime.Add(time.Duration(tf.Minutes) * time.Minute)
+		w.varTime[tf.Minutes] = varTime
+
+		w.flushTickers(tf.Minutes)
+	}
+
+	sessionStart := w.sessionStart[tf.Minutes]
+
+	if t.After(w.calendar.SessionEnd(sessionStart)) {
+		next, err := w.calendar.NextSessionStart(sessionStart)
+		if err != nil {
+			fmt.Printf("shard %d: unable to compute next session start: %s\n", w.id, err)
+			return
+		}
+
+		w.sessionStart[tf.Minutes] = next
+		w.varTime[tf.Minutes] = next
+		w.tickers[tf.Minutes][s[0]] = Candle{}
+	}
+
+	tickers := w.tickers[tf.Minutes]
+
+	if candle := tickers[s[0]]; (candle == Candle{}) {
+		candle, err := newCandle(s, w.varTime[tf.Minutes])
+		if err != nil {
+			fmt.Printf("shard %d: func newCandle crash: %s\n", w.id, err)
+			return
+		}
+
+		tickers[s[0]] = candle
+	} else {
+		tickers[s[0]] = changeCandle(s, tickers[s[0]])
+	}
+}
+
+// flushTickers выгружает накопленные свечки таймфрейма в его кольцевой буфер.
+func (w *shardWorker) flushTickers(tf int) {
+	start := time.Now()
+
+	tickers := w.tickers[tf]
+	ring := w.rings[tf]
+
+	for k, v := range tickers {
+		if (v != Candle{}) {
+			if !ring.push(v) {
+				w.metrics.incDropped()
+			}
+			tickers[k] = Candle{}
+		}
+	}
+
+	w.metrics.recordFlush(time.Since(start))
+}
+
+// validateShardConfig проверяет -shards/-buffer перед тем, как поднимать пул
+// воркеров: shardFor паникует делением на ноль при shardCount == 0, а
+// make([]*shardWorker, shardCount) — при отрицательном значении.
+func validateShardConfig(shardCount, bufferSize int) error {
+	if shardCount <= 0 {
+		return fmt.Errorf("-shards must be positive, got %d", shardCount)
+	}
+	if bufferSize <= 0 {
+		return fmt.Errorf("-buffer must be positive, got %d", bufferSize)
+	}
+	return nil
+}
+
+// shardFor выбирает шард по FNV-хэшу тикера.
+func shardFor(ticker string, shardCount int) int {
+	h := fnv.New32a()
+	h.Write([]byte(ticker))
+	return int(h.Sum32() % uint32(shardCount))
+}
+
+// ShardedAggregate — вторая стадия пайплайна: шардирует входной поток по
+// hash(ticker) % shardCount между пулом воркеров, каждый из которых держит
+// свою мапу свечек на таймфрейм и сбрасывает их в кольцевой буфер с
+// ограниченной памятью, так что медленный писатель больше не стопорит весь пайплайн.
+func ShardedAggregate(in chan []string, timeframes []Timeframe, calendar *SessionCalendar, startTime time.Time, shardCount, bufferSize int, metrics *Metrics) []chan Candle {
+	workers := make([]*shardWorker, shardCount)
+	for i := range workers {
+		workers[i] = newShardWorker(i, timeframes, calendar, startTime, bufferSize, metrics)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(shardCount)
+
+	for _, w := range workers {
+		go func(w *shardWorker) {
+			defer wg.Done()
+			w.run()
+		}(w)
+	}
+
+	go func() {
+		for s := range in {
+			shard := shardFor(s[0], shardCount)
+
+			select {
+			case workers[shard].in <- s:
+			default:
+				metrics.incDropped()
+			}
+
+			metrics.setQueueDepth(shard, len(workers[shard].in))
+		}
+
+		for _, w := range workers {
+			close(w.in)
+		}
+	}()
+
+	outs := make([]chan Candle, len(timeframes))
+	for i, tf := range timeframes {
+		outs[i] = make(chan Candle)
+		go drainRing(tf.Minutes, workers, outs[i], &wg)
+	}
+
+	return outs
+}
+
+// drainRing переливает свечки из кольцевых буферов всех шардов для одного
+// таймфрейма в общий выходной канал, который читает StageThree.
+func drainRing(tf int, workers []*shardWorker, out chan Candle, wg *sync.WaitGroup) {
+	defer close(out)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(2 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		drained := drainOnce(tf, workers, out)
+
+		select {
+		case <-done:
+			for drainOnce(tf, workers, out) {
+			}
+			return
+		default:
+		}
+
+		if !drained {
+			<-ticker.C
+		}
+	}
+}
+
+func drainOnce(tf int, workers []*shardWorker, out chan Candle) bool {
+	drained := false
+
+	for _, w := range workers {
+		for {
+			c, ok := w.rings[tf].pop()
+			if !ok {
+				break
+			}
+			out <- c
+			drained = true
+		}
+	}
+
+	return drained
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func tickAt(ticker, price string, t time.Time) []string {
+	return []string{ticker, price, "0", t.Format(timeFmt)}
+}
+
+// TestValidateShardConfig проверяет, что shardCount == 0 (деление на ноль в
+// shardFor) и отрицательные значения (make([]*shardWorker, n) паникует) не
+// доходят до ShardedAggregate, а отклоняются с обычной ошибкой.
+func TestValidateShardConfig(t *testing.T) {
+	cases := []struct {
+		name       string
+		shardCount int
+		bufferSize int
+		wantErr    bool
+	}{
+		{"valid", 4, 256, false},
+		{"zero shards", 0, 256, true},
+		{"negative shards", -1, 256, true},
+		{"zero buffer", 4, 0, true},
+		{"negative buffer", 4, -1, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateShardConfig(tc.shardCount, tc.bufferSize)
+			if tc.wantErr && err == nil {
+				t.Errorf("validateShardConfig(%d, %d): expected error, got nil", tc.shardCount, tc.bufferSize)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("validateShardConfig(%d, %d): unexpected error: %s", tc.shardCount, tc.bufferSize, err)
+			}
+		})
+	}
+}
+
+// TestShardWorkerSessionRolloverIsPerTimeframe воспроизводит регрессию: раньше
+// один общий w.startTime продвигался первым же обработанным таймфреймом, и
+// остальные таймфреймы того же тика видели уже сдвинутый startTime и не
+// сбрасывали свои накопленные свечки на границе сессии.
+func TestShardWorkerSessionRolloverIsPerTimeframe(t *testing.T) {
+	loc := time.UTC
+	calendar := &SessionCalendar{
+		Location: loc,
+		OpenTime: "07:00:00.000000",
+		Session:  1 * time.Hour,
+	}
+
+	sessionStart := time.Date(2026, 7, 24, 7, 0, 0, 0, loc)
+	metrics := NewMetrics(1)
+	timeframes := []Timeframe{{Minutes: 5}, {Minutes: 30}, {Minutes: 240}}
+
+	w := newShardWorker(0, timeframes, calendar, sessionStart, 16, metrics)
+
+	// Тик внутри первой сессии, чтобы у каждого таймфрейма появилась свечка "вчерашнего" дня.
+	w.processTick(tickAt("TEST", "100", sessionStart.Add(10*time.Minute)), sessionStart.Add(10*time.Minute), timeframes[0])
+	w.processTick(tickAt("TEST", "100", sessionStart.Add(10*time.Minute)), sessionStart.Add(10*time.Minute), timeframes[1])
+	w.processTick(tickAt("TEST", "100", sessionStart.Add(10*time.Minute)), sessionStart.Add(10*time.Minute), timeframes[2])
+
+	// Тик на следующий день, после конца сессии — должен откатить состояние
+	// всех трёх таймфреймов, а не только первого обработанного.
+	next := sessionStart.AddDate(0, 0, 1).Add(10 * time.Minute)
+	for _, tf := range timeframes {
+		w.processTick(tickAt("TEST", "200", next), next, tf)
+	}
+
+	for _, tf := range timeframes {
+		got := w.sessionStart[tf.Minutes]
+		if !got.After(sessionStart) {
+			t.Errorf("tf=%d: sessionStart not advanced, got %v want after %v", tf.Minutes, got, sessionStart)
+		}
+
+		candle := w.tickers[tf.Minutes]["TEST"]
+		if candle.openPrice != 200 {
+			t.Errorf("tf=%d: expected new session's candle (open=200), got open=%v (stale candle carried over from previous session)", tf.Minutes, candle.openPrice)
+		}
+	}
+}
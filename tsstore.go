@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Формат сегментного файла: заголовок фиксированного размера,
+// далее — последовательность записей свечек фиксированной ширины.
+const (
+	segMagic        uint32 = 0x54534442 // "TSDB"
+	segVersion      uint32 = 1
+	segHeaderSize   int    = 64
+	candleRecSize   int    = 40 // ts int64 + 4 float64 (o/h/l/c)
+	tickerFieldSize int    = 16
+)
+
+// segmentHeader хранится в начале каждого сегментного файла.
+type segmentHeader struct {
+	magic     uint32
+	version   uint32
+	ticker    [tickerFieldSize]byte
+	timeframe int32
+	minTS     int64
+	maxTS     int64
+}
+
+func (h *segmentHeader) marshal() []byte {
+	buf := make([]byte, segHeaderSize)
+	binary.BigEndian.PutUint32(buf[0:4], h.magic)
+	binary.BigEndian.PutUint32(buf[4:8], h.version)
+	copy(buf[8:8+tickerFieldSize], h.ticker[:])
+	binary.BigEndian.PutUint32(buf[24:28], uint32(h.timeframe))
+	binary.BigEndian.PutUint64(buf[28:36], uint64(h.minTS))
+	binary.BigEndian.PutUint64(buf[36:44], uint64(h.maxTS))
+	return buf
+}
+
+func (h *segmentHeader) unmarshal(buf []byte) error {
+	if len(buf) < segHeaderSize {
+		return fmt.Errorf("segment header too short: %d bytes", len(buf))
+	}
+
+	h.magic = binary.BigEndian.Uint32(buf[0:4])
+	if h.magic != segMagic {
+		return fmt.Errorf("bad segment magic: %x", h.magic)
+	}
+
+	h.version = binary.BigEndian.Uint32(buf[4:8])
+	copy(h.ticker[:], buf[8:8+tickerFieldSize])
+	h.timeframe = int32(binary.BigEndian.Uint32(buf[24:28]))
+	h.minTS = int64(binary.BigEndian.Uint64(buf[28:36]))
+	h.maxTS = int64(binary.BigEndian.Uint64(buf[36:44]))
+
+	return nil
+}
+
+func tickerKey(ticker string) [tickerFieldSize]byte {
+	var out [tickerFieldSize]byte
+	copy(out[:], ticker)
+	return out
+}
+
+// segment — один мемори-мапленный файл с свечками одного (ticker, timeframe).
+type segment struct {
+	file   *os.File
+	mapped []byte
+	header segmentHeader
+}
+
+func segmentPath(dir, ticker string, tf int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_%dm.seg", ticker, tf))
+}
+
+// openSegment открывает существующий сегмент и мапит его в память для чтения.
+func openSegment(dir, ticker string, tf int) (*segment, error) {
+	path := segmentPath(dir, ticker, tf)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to stat segment: %s", err)
+	}
+
+	if info.Size() < int64(segHeaderSize) {
+		file.Close()
+		return nil, fmt.Errorf("segment %s is truncated", path)
+	}
+
+	mapped, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to mmap segment: %s", err)
+	}
+
+	s := &segment{file: file, mapped: mapped}
+	if err := s.header.unmarshal(mapped); err != nil {
+		syscall.Munmap(mapped)
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// createSegment создаёт новый сегментный файл с пустым заголовком.
+func createSegment(dir, ticker string, tf int) (*segment, error) {
+	path := segmentPath(dir, ticker, tf)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	header := segmentHeader{
+		magic:     segMagic,
+		version:   segVersion,
+		ticker:    tickerKey(ticker),
+		timeframe: int32(tf),
+	}
+
+	if _, err := file.Write(header.marshal()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to write segment header: %s", err)
+	}
+
+	mapped, err := syscall.Mmap(int(file.Fd()), 0, segHeaderSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to mmap segment: %s", err)
+	}
+
+	return &segment{file: file, mapped: mapped, header: header}, nil
+}
+
+// appendCandle дозаписывает свечку в конец сегмента и переотображает файл в память.
+func (s *segment) appendCandle(c Candle) error {
+	rec := marshalCandle(c)
+
+	if _, err := s.file.WriteAt(rec, int64(len(s.mapped))); err != nil {
+		return fmt.Errorf("unable to append candle record: %s", err)
+	}
+
+	ts := c.ts.UnixNano()
+	if s.header.minTS == 0 || ts < s.header.minTS {
+		s.header.minTS = ts
+	}
+	if ts > s.header.maxTS {
+		s.header.maxTS = ts
+	}
+
+	if _, err := s.file.WriteAt(s.header.marshal(), 0); err != nil {
+		return fmt.Errorf("unable to update segment header: %s", err)
+	}
+
+	if err := syscall.Munmap(s.mapped); err != nil {
+		return fmt.Errorf("unable to unmap segment: %s", err)
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat segment: %s", err)
+	}
+
+	s.mapped, err = syscall.Mmap(int(s.file.Fd()), 0, int(info.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("unable to remap segment: %s", err)
+	}
+
+	return nil
+}
+
+// queryRange возвращает свечки сегмента, попадающие в [from, to], бинарным поиском по ts.
+func (s *segment) queryRange(from, to time.Time) []Candle {
+	body := s.mapped[segHeaderSize:]
+	n := len(body) / candleRecSize
+
+	lo := sort.Search(n, func(i int) bool {
+		return unmarshalTS(body[i*candleRecSize:]) >= from.UnixNano()
+	})
+
+	var out []Candle
+	for i := lo; i < n; i++ {
+		rec := body[i*candleRecSize : (i+1)*candleRecSize]
+		if unmarshalTS(rec) > to.UnixNano() {
+			break
+		}
+		out = append(out, unmarshalCandle(rec, s.header.ticker))
+	}
+
+	return out
+}
+
+func (s *segment) close() error {
+	if err := syscall.Munmap(s.mapped); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+func marshalCandle(c Candle) []byte {
+	buf := make([]byte, candleRecSize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(c.ts.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:16], math.Float64bits(c.openPrice))
+	binary.BigEndian.PutUint64(buf[16:24], math.Float64bits(c.maxPrice))
+	binary.BigEndian.PutUint64(buf[24:32], math.Float64bits(c.minPrice))
+	binary.BigEndian.PutUint64(buf[32:40], math.Float64bits(c.closePrice))
+	return buf
+}
+
+func unmarshalTS(rec []byte) int64 {
+	return int64(binary.BigEndian.Uint64(rec[0:8]))
+}
+
+func unmarshalCandle(rec []byte, ticker [tickerFieldSize]byte) Candle {
+	return Candle{
+		ticker:     trimTicker(ticker),
+		ts:         time.Unix(0, unmarshalTS(rec)),
+		openPrice:  math.Float64frombits(binary.BigEndian.Uint64(rec[8:16])),
+		maxPrice:   math.Float64frombits(binary.BigEndian.Uint64(rec[16:24])),
+		minPrice:   math.Float64frombits(binary.BigEndian.Uint64(rec[24:32])),
+		closePrice: math.Float64frombits(binary.BigEndian.Uint64(rec[32:40])),
+	}
+}
+
+func trimTicker(raw [tickerFieldSize]byte) string {
+	i := 0
+	for i < len(raw) && raw[i] != 0 {
+		i++
+	}
+	return string(raw[:i])
+}
+
+// --- WAL -------------------------------------------------------------------
+
+// wal — журнал упреждающей записи из framed-записей crc32|len|payload, где payload —
+// таймфрейм, тикер и сериализованная свечка.
+type wal struct {
+	mu   sync.Mutex
+	file *os.File
+	path string
+}
+
+func openWAL(dir string) (*wal, error) {
+	path := filepath.Join(dir, "wal.log")
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open wal: %s", err)
+	}
+
+	return &wal{file: file, path: path}, nil
+}
+
+// appendCandle пишет framed-запись crc32|len|payload и fsync'ит файл.
+// Таймфрейм пишется в payload, чтобы replay мог восстановить свечку в правильный
+// сегмент без догадок по тикеру.
+func (w *wal) appendCandle(c Candle, tf int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	payload := marshalCandle(c)
+	payload = append([]byte(c.ticker+"\x00"), payload...)
+	tfBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(tfBuf, uint32(tf))
+	payload = append(tfBuf, payload...)
+
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	copy(frame[8:], payload)
+	binary.BigEndian.PutUint32(frame[0:4], crc32.ChecksumIEEE(payload))
+
+	if _, err := w.file.Write(frame); err != nil {
+		return fmt.Errorf("unable to write wal entry: %s", err)
+	}
+
+	return w.file.Sync()
+}
+
+// walRecord — свечка вместе с таймфреймом, восстановленная при replay WAL.
+type walRecord struct {
+	candle Candle
+	tf     int
+}
+
+// replay вычитывает все валидные записи WAL для восстановления несброшенных свечек.
+func (w *wal) replay() ([]walRecord, error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("unable to seek wal: %s", err)
+	}
+
+	var out []walRecord
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(w.file, header); err != nil {
+			if err == io.EOF {
+				break
+			}
+			// Неполная последняя запись (крах посреди записи) — обрываем replay здесь.
+			break
+		}
+
+		sum := binary.BigEndian.Uint32(header[0:4])
+		length := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(w.file, payload); err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(payload) != sum {
+			fmt.Printf("wal: dropping corrupt entry at checksum mismatch\n")
+			continue
+		}
+
+		if len(payload) < 4 {
+			continue
+		}
+		tf := int(binary.BigEndian.Uint32(payload[0:4]))
+		body := payload[4:]
+
+		nul := indexByte(body, 0)
+		if nul < 0 {
+			continue
+		}
+
+		ticker := string(body[:nul])
+		rec := body[nul+1:]
+		out = append(out, walRecord{candle: unmarshalCandle(rec, tickerKey(ticker)), tf: tf})
+	}
+
+	if _, err := w.file.Seek(0, io.SeekEnd); err != nil {
+		return nil, fmt.Errorf("unable to seek wal to end: %s", err)
+	}
+
+	return out, nil
+}
+
+// truncate обнуляет WAL после того, как соответствующий сегмент сброшен и fsync'нут.
+func (w *wal) truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("unable to truncate wal: %s", err)
+	}
+
+	_, err := w.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+func indexByte(b []byte, c byte) int {
+	for i, v := range b {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// --- Store ------------------------------------------------------------------
+
+// Store — хранилище свечек на диске: по сегменту на (ticker, timeframe) плюс общий WAL.
+type Store struct {
+	mu       sync.Mutex
+	dir      string
+	segments map[string]*segment
+	wal      *wal
+}
+
+func segKey(ticker string, tf int) string {
+	return fmt.Sprintf("%s|%d", ticker, tf)
+}
+
+// NewStore открывает (создавая при необходимости) каталог хранилища и реплеит WAL,
+// чтобы восстановить свечки, не попавшие в сегменты до краха.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create store dir: %s", err)
+	}
+
+	w, err := openWAL(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, segments: make(map[string]*segment), wal: w}
+
+	pending, err := w.replay()
+	if err != nil {
+		return nil, fmt.Errorf("unable to replay wal: %s", err)
+	}
+
+	for _, rec := range pending {
+		if err := s.flushToSegment(rec.candle, rec.tf); err != nil {
+			return nil, fmt.Errorf("unable to reconstruct candle from wal: %s", err)
+		}
+	}
+
+	if len(pending) > 0 {
+		if err := w.truncate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Append записывает свечку в WAL для гарантии durability, а затем в сегмент.
+// После fsync сегмента соответствующая запись в WAL больше не нужна.
+// Append-flush-truncate выполняются под одним и тем же s.mu, чтобы конкурентные
+// вызовы (по одному на таймфрейм из StageThree) не обнуляли WAL между чужим
+// append и чужим flush.
+func (s *Store) Append(c Candle, tf int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.wal.appendCandle(c, tf); err != nil {
+		return err
+	}
+
+	if err := s.flushToSegmentLocked(c, tf); err != nil {
+		return err
+	}
+
+	return s.wal.truncate()
+}
+
+// flushToSegment блокирует s.mu самостоятельно; используется там, где вызывающая
+// сторона ещё не держит лок (например, восстановление из WAL в NewStore).
+func (s *Store) flushToSegment(c Candle, tf int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flushToSegmentLocked(c, tf)
+}
+
+// flushToSegmentLocked — тело flushToSegment, вызывающая сторона уже держит s.mu.
+func (s *Store) flushToSegmentLocked(c Candle, tf int) error {
+	key := segKey(c.ticker, tf)
+
+	seg, ok := s.segments[key]
+	if !ok {
+		var err error
+		if _, statErr := os.Stat(segmentPath(s.dir, c.ticker, tf)); statErr == nil {
+			seg, err = openSegment(s.dir, c.ticker, tf)
+		} else {
+			seg, err = createSegment(s.dir, c.ticker, tf)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to open segment for %s: %s", key, err)
+		}
+		s.segments[key] = seg
+	}
+
+	if err := seg.appendCandle(c); err != nil {
+		return err
+	}
+
+	return seg.file.Sync()
+}
+
+// AppendTF — то же самое, что Append, сохранено для вызывающей стороны (StageThree),
+// которая всегда знает таймфрейм свечки явно.
+func (s *Store) AppendTF(c Candle, tf int) error {
+	return s.Append(c, tf)
+}
+
+// Query возвращает свечки тикера/таймфрейма в диапазоне [from, to], используя
+// бинарный поиск по мемори-маппленному сегменту, без декодирования всего файла.
+func (s *Store) Query(ticker string, tf int, from, to time.Time) ([]Candle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := segKey(ticker, tf)
+
+	seg, ok := s.segments[key]
+	if !ok {
+		if _, err := os.Stat(segmentPath(s.dir, ticker, tf)); err != nil {
+			return nil, nil
+		}
+
+		var err error
+		seg, err = openSegment(s.dir, ticker, tf)
+		if err != nil {
+			return nil, err
+		}
+		s.segments[key] = seg
+	}
+
+	return seg.queryRange(from, to), nil
+}
+
+// Close закрывает WAL и все открытые сегменты. Ошибка закрытия одного сегмента не
+// должна помешать закрытию остальных, поэтому все ошибки накапливаются и
+// возвращаются вместе.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+
+	for _, seg := range s.segments {
+		if err := seg.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := s.wal.close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
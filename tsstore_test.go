@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenSegmentRejectsTruncatedFile(t *testing.T) {
+	dir := t.TempDir()
+
+	seg, err := createSegment(dir, "TEST", 5)
+	if err != nil {
+		t.Fatalf("createSegment: %s", err)
+	}
+	path := seg.file.Name()
+	if err := seg.close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	if err := os.Truncate(path, int64(segHeaderSize)-1); err != nil {
+		t.Fatalf("os.Truncate: %s", err)
+	}
+
+	if _, err := openSegment(dir, "TEST", 5); err == nil {
+		t.Fatal("expected openSegment to reject a truncated segment, got nil error")
+	}
+}
+
+// TestStoreCloseClosesEverythingDespiteOneSegmentFailing проверяет, что ошибка
+// закрытия одного сегмента не мешает закрыть остальные сегменты и WAL.
+func TestStoreCloseClosesEverythingDespiteOneSegmentFailing(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore: %s", err)
+	}
+
+	if err := store.AppendTF(Candle{ticker: "BAD", ts: time.Unix(0, 0)}, 5); err != nil {
+		t.Fatalf("AppendTF(BAD): %s", err)
+	}
+	if err := store.AppendTF(Candle{ticker: "GOOD", ts: time.Unix(0, 0)}, 5); err != nil {
+		t.Fatalf("AppendTF(GOOD): %s", err)
+	}
+
+	// Закрываем файловый дескриптор сегмента BAD заранее, чтобы Store.Close получил
+	// ошибку именно на нём, и могли убедиться, что сегмент GOOD и WAL всё равно закрываются.
+	badSeg := store.segments[segKey("BAD", 5)]
+	if err := badSeg.file.Close(); err != nil {
+		t.Fatalf("pre-close BAD segment file: %s", err)
+	}
+
+	if err := store.Close(); err == nil {
+		t.Fatal("expected Close to report the BAD segment's close failure")
+	}
+
+	goodSeg := store.segments[segKey("GOOD", 5)]
+	if err := goodSeg.file.Close(); err == nil {
+		t.Error("expected GOOD segment's file to already be closed by Store.Close")
+	}
+
+	if err := store.wal.file.Close(); err == nil {
+		t.Error("expected WAL file to already be closed by Store.Close")
+	}
+}
+
+// TestStoreAppendConcurrentTimeframes воспроизводит StageThree: по одной горутине
+// на таймфрейм, пишущей в общий Store.wal. Append должен сериализовать
+// append-flush-truncate так, чтобы ни одна свечка не терялась.
+func TestStoreAppendConcurrentTimeframes(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore: %s", err)
+	}
+	defer store.Close()
+
+	const candlesPerTF = 50
+	timeframes := []int{5, 30, 240}
+
+	var wg sync.WaitGroup
+	for _, tf := range timeframes {
+		wg.Add(1)
+		go func(tf int) {
+			defer wg.Done()
+			for i := 0; i < candlesPerTF; i++ {
+				c := Candle{
+					ticker:    "TEST",
+					ts:        time.Unix(int64(i*tf*60), 0),
+					openPrice: float64(i),
+				}
+				if err := store.AppendTF(c, tf); err != nil {
+					t.Errorf("AppendTF(tf=%d, i=%d): %s", tf, i, err)
+				}
+			}
+		}(tf)
+	}
+	wg.Wait()
+
+	for _, tf := range timeframes {
+		got, err := store.Query("TEST", tf, time.Unix(0, 0), time.Unix(int64(candlesPerTF*tf*60), 0))
+		if err != nil {
+			t.Fatalf("Query(tf=%d): %s", tf, err)
+		}
+		if len(got) != candlesPerTF {
+			t.Errorf("tf=%d: got %d candles, want %d", tf, len(got), candlesPerTF)
+		}
+	}
+}
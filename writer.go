@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// partitionedWriter раскладывает свечки одного таймфрейма по файлам
+// <dest>/<SYMBOL>/<YYYY>/<MM>/<DD>/<TF>m.csv, ротируя файл тикера на границе
+// торговой сессии (а не календарной даты тика, которая может не совпадать с
+// сессией, если та пересекает полночь) и атомарно публикуя его через
+// temp-file + os.Rename.
+type partitionedWriter struct {
+	dest     string
+	tf       int
+	calendar *SessionCalendar
+	files    map[string]*partitionFile // ticker -> текущий открытый файл
+}
+
+// partitionFile — один ещё не зафиксированный партиционный файл вместе с его
+// .idx sidecar'ом (час -> байтовое смещение в CSV).
+type partitionFile struct {
+	sessionStart time.Time
+	tmpPath      string
+	finalPath    string
+	idxTmpPath   string
+	idxPath      string
+	file         *os.File
+	idx          *os.File
+	lastHour     int
+	offset       int64
+}
+
+func newPartitionedWriter(dest string, tf int, calendar *SessionCalendar) *partitionedWriter {
+	return &partitionedWriter{dest: dest, tf: tf, calendar: calendar, files: make(map[string]*partitionFile)}
+}
+
+// Write пишет свечку в партицию её тикера, открывая новый файл, если это первая
+// свечка тикера, и ротируя (финализируя) предыдущий, если тик принадлежит уже
+// другой торговой сессии.
+func (w *partitionedWriter) Write(c Candle) error {
+	sessionStart, err := w.calendar.SessionFor(c.ts)
+	if err != nil {
+		return fmt.Errorf("unable to determine session for candle: %s", err)
+	}
+
+	pf, ok := w.files[c.ticker]
+	if ok && !pf.sessionStart.Equal(sessionStart) {
+		if err := pf.finalize(); err != nil {
+			return fmt.Errorf("unable to rotate partition for %s: %s", c.ticker, err)
+		}
+		delete(w.files, c.ticker)
+		ok = false
+	}
+
+	if !ok {
+		pf, err = w.openPartition(c.ticker, sessionStart)
+		if err != nil {
+			return err
+		}
+		w.files[c.ticker] = pf
+	}
+
+	return pf.write(c)
+}
+
+func (w *partitionedWriter) openPartition(ticker string, sessionStart time.Time) (*partitionFile, error) {
+	dir := filepath.Join(w.dest, ticker, fmt.Sprintf("%04d", sessionStart.Year()), fmt.Sprintf("%02d", sessionStart.Month()), fmt.Sprintf("%02d", sessionStart.Day()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create partition dir: %s", err)
+	}
+
+	final := filepath.Join(dir, fmt.Sprintf("%dm.csv", w.tf))
+	tmp := final + ".tmp"
+	idxPath := final + ".idx"
+	idxTmp := idxPath + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temp partition file: %s", err)
+	}
+
+	idx, err := os.Create(idxTmp)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to create idx sidecar: %s", err)
+	}
+
+	return &partitionFile{
+		sessionStart: sessionStart,
+		tmpPath:      tmp,
+		finalPath:    final,
+		idxTmpPath:   idxTmp,
+		idxPath:      idxPath,
+		file:         file,
+		idx:          idx,
+		lastHour:     -1,
+	}, nil
+}
+
+// write дописывает свечку в CSV и, при переходе в новый час, фиксирует в .idx
+// байтовое смещение начала этого часа.
+func (pf *partitionFile) write(c Candle) error {
+	if hour := c.ts.Hour(); hour != pf.lastHour {
+		if _, err := fmt.Fprintf(pf.idx, "%02d:%d\n", hour, pf.offset); err != nil {
+			return fmt.Errorf("unable to write idx entry: %s", err)
+		}
+		pf.lastHour = hour
+	}
+
+	t := c.ts.Format("2006-01-02T15:04:05Z")
+	note := fmt.Sprintf("%s,%v,%v,%v,%v,%v\n", c.ticker, t, c.openPrice, c.maxPrice, c.minPrice, c.closePrice)
+
+	n, err := pf.file.WriteString(note)
+	if err != nil {
+		return fmt.Errorf("unable to write candle: %s", err)
+	}
+
+	pf.offset += int64(n)
+
+	return nil
+}
+
+// finalize fsync'ит и закрывает CSV и sidecar, затем публикует оба атомарным
+// переименованием, так что крах посреди записи никогда не оставляет усечённый
+// CSV или частично записанный .idx на его постоянном имени.
+func (pf *partitionFile) finalize() error {
+	if err := pf.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync partition file: %s", err)
+	}
+
+	if err := pf.file.Close(); err != nil {
+		return fmt.Errorf("unable to close partition file: %s", err)
+	}
+
+	if err := pf.idx.Sync(); err != nil {
+		return fmt.Errorf("unable to sync idx sidecar: %s", err)
+	}
+
+	if err := pf.idx.Close(); err != nil {
+		return fmt.Errorf("unable to close idx sidecar: %s", err)
+	}
+
+	if err := os.Rename(pf.tmpPath, pf.finalPath); err != nil {
+		return err
+	}
+
+	return os.Rename(pf.idxTmpPath, pf.idxPath)
+}
+
+// Close финализирует все ещё открытые партиции — вызывается по завершении пайплайна.
+// Ошибка на одном тикере не должна мешать финализации остальных, поэтому все ошибки
+// накапливаются и возвращаются вместе.
+func (w *partitionedWriter) Close() error {
+	var errs []error
+
+	for ticker, pf := range w.files {
+		if err := pf.finalize(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to finalize partition for %s: %s", ticker, err))
+		}
+		delete(w.files, ticker)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openPartitionFileForTest(t *testing.T, tmp, final string) *partitionFile {
+	t.Helper()
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		t.Fatalf("create tmp: %s", err)
+	}
+
+	idx, err := os.Create(tmp + ".idx.tmp")
+	if err != nil {
+		t.Fatalf("create idx: %s", err)
+	}
+
+	return &partitionFile{
+		tmpPath:    tmp,
+		finalPath:  final,
+		idxTmpPath: tmp + ".idx.tmp",
+		idxPath:    final + ".idx",
+		file:       file,
+		idx:        idx,
+		lastHour:   -1,
+	}
+}
+
+// TestPartitionedWriterCloseFinalizesEveryTickerDespiteOneFailing проверяет, что
+// ошибка финализации одного тикера (например, отсутствует целевая директория)
+// не мешает финализировать остальные.
+func TestPartitionedWriterCloseFinalizesEveryTickerDespiteOneFailing(t *testing.T) {
+	dir := t.TempDir()
+
+	good := openPartitionFileForTest(t, filepath.Join(dir, "good.csv.tmp"), filepath.Join(dir, "good.csv"))
+	bad := openPartitionFileForTest(t, filepath.Join(dir, "bad.csv.tmp"), filepath.Join(dir, "missing-subdir", "bad.csv"))
+
+	w := &partitionedWriter{
+		dest:  dir,
+		files: map[string]*partitionFile{"GOOD": good, "BAD": bad},
+	}
+
+	err := w.Close()
+	if err == nil {
+		t.Fatal("expected Close to report the BAD ticker's rename failure")
+	}
+
+	if _, statErr := os.Stat(filepath.Join(dir, "good.csv")); statErr != nil {
+		t.Errorf("GOOD ticker was not finalized despite BAD ticker failing: %s", statErr)
+	}
+
+	if len(w.files) != 0 {
+		t.Errorf("expected all partitions to be cleared from the map, got %d left", len(w.files))
+	}
+}
+
+// TestPartitionedWriterRotatesOnSessionBoundaryNotCalendarDate воспроизводит
+// регрессию: раньше ротация была ключована по календарной дате тика, поэтому
+// сессия, пересекающая полночь, распадалась на два файла, а два разных
+// торговых дня, случайно совпавших по дате, склеивались в один.
+func TestPartitionedWriterRotatesOnSessionBoundaryNotCalendarDate(t *testing.T) {
+	calendar := &SessionCalendar{
+		Location: time.UTC,
+		OpenTime: "22:00:00.000000",
+		Session:  8 * time.Hour, // 22:00 -> 06:00 следующего календарного дня
+	}
+
+	dir := t.TempDir()
+	w := newPartitionedWriter(dir, 5, calendar)
+
+	day1 := time.Date(2026, 7, 24, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+
+	tickBeforeMidnight := Candle{ticker: "TEST", ts: day1.Add(23*time.Hour + 30*time.Minute), openPrice: 1}
+	tickAfterMidnight := Candle{ticker: "TEST", ts: day2.Add(1*time.Hour + 30*time.Minute), openPrice: 2}
+	tickNextSession := Candle{ticker: "TEST", ts: day2.Add(23 * time.Hour), openPrice: 3}
+
+	if err := w.Write(tickBeforeMidnight); err != nil {
+		t.Fatalf("Write(tickBeforeMidnight): %s", err)
+	}
+	pfAfterFirst := w.files["TEST"]
+
+	if err := w.Write(tickAfterMidnight); err != nil {
+		t.Fatalf("Write(tickAfterMidnight): %s", err)
+	}
+	if w.files["TEST"] != pfAfterFirst {
+		t.Error("tick just after midnight rotated to a new file even though it belongs to the same overnight session")
+	}
+
+	if err := w.Write(tickNextSession); err != nil {
+		t.Fatalf("Write(tickNextSession): %s", err)
+	}
+	if w.files["TEST"] == pfAfterFirst {
+		t.Error("tick from the next trading session did not rotate to a new file")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	firstSessionCSV := filepath.Join(dir, "TEST", "2026", "07", "24", "5m.csv")
+	secondSessionCSV := filepath.Join(dir, "TEST", "2026", "07", "25", "5m.csv")
+
+	if _, err := os.Stat(firstSessionCSV); err != nil {
+		t.Errorf("expected overnight session file at %s: %s", firstSessionCSV, err)
+	}
+	if _, err := os.Stat(secondSessionCSV); err != nil {
+		t.Errorf("expected next session file at %s: %s", secondSessionCSV, err)
+	}
+}
+
+// TestPartitionFileIdxIsAtomicallyRenamedOnFinalize проверяет, что .idx
+// sidecar живёт под временным именем до finalize и появляется на постоянном
+// пути только атомарным переименованием — так же, как CSV.
+func TestPartitionFileIdxIsAtomicallyRenamedOnFinalize(t *testing.T) {
+	calendar := &SessionCalendar{Location: time.UTC, OpenTime: "00:00:00.000000", Session: 24 * time.Hour}
+	dir := t.TempDir()
+	w := newPartitionedWriter(dir, 5, calendar)
+
+	ts := time.Date(2026, 7, 24, 10, 0, 0, 0, time.UTC)
+	if err := w.Write(Candle{ticker: "TEST", ts: ts, openPrice: 1}); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	pf := w.files["TEST"]
+	if _, err := os.Stat(pf.idxPath); err == nil {
+		t.Error("idx sidecar exists at its final path before finalize")
+	}
+	if _, err := os.Stat(pf.idxTmpPath); err != nil {
+		t.Errorf("expected idx sidecar at its temp path before finalize: %s", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if _, err := os.Stat(pf.idxPath); err != nil {
+		t.Errorf("expected idx sidecar at its final path after finalize: %s", err)
+	}
+	if _, err := os.Stat(pf.idxTmpPath); err == nil {
+		t.Error("idx temp path still exists after finalize")
+	}
+}